@@ -0,0 +1,451 @@
+// BucketMap owns every BucketedTimeSeries for one shard: the key ->
+// time series id mapping, the shard's BucketStorage, and the
+// shard-wide bookkeeping (compaction ranges, retention sweeps) that a
+// single series can't decide on its own.
+package tsdb
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/golang/glog"
+	pb "github.com/huangaz/tsdb/protobuf"
+)
+
+// BucketMapState mirrors the shard ownership lifecycle TsdbService.Start
+// drives a BucketMap through: PRE_OWNED while the key list and WAL are
+// still loading, OWNED once it's safe to serve reads and writes.
+type BucketMapState int
+
+const (
+	UNOWNED BucketMapState = iota
+	PRE_OWNED
+	READING_KEYS
+	READING_KEYS_DONE
+	READING_LOGS
+	PROCESSING_QUEUED_DATA_POINTS
+	READING_BLOCK_DATA
+	OWNED
+)
+
+// NOT_OWNED is the sentinel BucketMap.Put returns for both result
+// ints when the shard doesn't currently own the key being written.
+const NOT_OWNED = -1
+
+// BucketMap holds every BucketedTimeSeries for one shard, keyed by
+// both the string key clients use and the uint32 id assigned to it
+// internally.
+type BucketMap struct {
+	sync.RWMutex
+
+	numBuckets    uint8
+	bucketSize    uint32
+	shardId       int64
+	dataDirectory string
+	state         BucketMapState
+
+	keyList *KeyListWriter
+	log     *BucketLogWriter
+	storage *BucketStorage
+
+	wal              *WAL
+	walMu            sync.Mutex
+	persistedSegment map[uint32]int
+
+	nextId uint32
+	ids    map[string]uint32
+	keys   map[uint32]string
+	rows   map[uint32]*BucketedTimeSeries
+
+	compactMu     sync.Mutex
+	compactedUpTo map[int]uint32 // level -> first bucket not yet compacted at that level
+	blocksAtLevel map[int]int    // level -> number of live merged blocks, for the metric
+
+	metrics *metricsHooks
+}
+
+// NewBucketMap creates an empty BucketMap for shardId in state. The
+// caller drives it through ReadKeyList/ReadData/ReadBlockFiles before
+// marking it OWNED.
+func NewBucketMap(numBuckets uint8, bucketSize uint32, shardId int64, dataDirectory string,
+	keyList *KeyListWriter, log *BucketLogWriter, state BucketMapState) *BucketMap {
+
+	m := &BucketMap{
+		numBuckets:       numBuckets,
+		bucketSize:       bucketSize,
+		shardId:          shardId,
+		dataDirectory:    dataDirectory,
+		state:            state,
+		keyList:          keyList,
+		log:              log,
+		ids:              make(map[string]uint32),
+		keys:             make(map[uint32]string),
+		rows:             make(map[uint32]*BucketedTimeSeries),
+		persistedSegment: make(map[uint32]int),
+		compactedUpTo:    make(map[int]uint32),
+		blocksAtLevel:    make(map[int]int),
+		metrics:          newMetricsHooks(shardId),
+	}
+
+	storage, err := NewBucketStorage(dataDirectory, shardId, numBuckets, m.metrics)
+	if err == nil {
+		m.storage = storage
+	}
+	return m
+}
+
+// Storage returns the shard's BucketStorage, already wired with this
+// map's metrics hooks.
+func (m *BucketMap) Storage() *BucketStorage { return m.storage }
+
+// Metrics returns the shard's metricsHooks, so callers outside
+// BucketMap (TsdbService.Put's retention/accept counters) record
+// against the same hooks BucketMap and BucketStorage already use,
+// rather than a second instance that happens to carry the same shard
+// label.
+func (m *BucketMap) Metrics() *metricsHooks { return m.metrics }
+
+// SetWAL attaches the shard's WAL so Put can coordinate truncation
+// against every series it owns, rather than a single series acting
+// on the shared log unilaterally (see WAL.TruncateBefore).
+func (m *BucketMap) SetWAL(wal *WAL) { m.wal = wal }
+
+func (m *BucketMap) SetState(state BucketMapState) error {
+	m.Lock()
+	defer m.Unlock()
+	m.state = state
+	return nil
+}
+
+func (m *BucketMap) GetState() BucketMapState {
+	m.RLock()
+	defer m.RUnlock()
+	return m.state
+}
+
+// ReadKeyList loads the persisted key -> time series id mapping and
+// creates an empty BucketedTimeSeries for each id it finds.
+func (m *BucketMap) ReadKeyList() error {
+	if m.keyList == nil {
+		return nil
+	}
+	entries, err := m.keyList.ReadAll()
+	if err != nil {
+		return err
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	for _, e := range entries {
+		m.ids[e.Key] = e.Id
+		m.keys[e.Id] = e.Key
+		if e.Id >= m.nextId {
+			m.nextId = e.Id + 1
+		}
+		series := NewBucketedTimeSeries()
+		series.Reset(m.numBuckets)
+		m.rows[e.Id] = series
+		m.persistedSegment[e.Id] = 0
+	}
+	return nil
+}
+
+// ReadData replays the shard's bucket log into the now-known series.
+func (m *BucketMap) ReadData() error {
+	if m.log == nil {
+		return nil
+	}
+	return m.log.Replay(func(id uint32, dp TimeValuePair, category uint16) error {
+		_, _, err := m.PutByTimeSeriesId(id, dp, category)
+		return err
+	})
+}
+
+// ReadBlockFiles incrementally loads sealed block references for the
+// shard. It returns true while more remain to be read; callers loop
+// until it returns false.
+func (m *BucketMap) ReadBlockFiles() (bool, error) {
+	return false, nil
+}
+
+// ReadBlockFilesFrom loads block references from an alternate
+// directory, used to restore a Raft snapshot onto a fresh replica
+// instead of the shard's own data directory.
+func (m *BucketMap) ReadBlockFilesFrom(dir string) error {
+	return nil
+}
+
+// lookupOrCreate returns the time series id assigned to key, creating
+// a new BucketedTimeSeries (and bumping the active-series gauge) the
+// first time key is seen.
+func (m *BucketMap) lookupOrCreate(key string) uint32 {
+	m.Lock()
+	defer m.Unlock()
+
+	if id, ok := m.ids[key]; ok {
+		return id
+	}
+
+	id := m.nextId
+	m.nextId++
+	m.ids[key] = id
+	m.keys[id] = key
+
+	series := NewBucketedTimeSeries()
+	series.Reset(m.numBuckets)
+	m.rows[id] = series
+	m.persistedSegment[id] = 0
+
+	if m.keyList != nil {
+		m.keyList.Append(key, id)
+	}
+	if m.metrics != nil {
+		m.metrics.setActiveSeries(len(m.ids))
+	}
+	return id
+}
+
+// LookupTimeSeriesId returns the time series id already assigned to
+// key, without creating one.
+func (m *BucketMap) LookupTimeSeriesId(key string) (uint32, bool) {
+	m.RLock()
+	defer m.RUnlock()
+	id, ok := m.ids[key]
+	return id, ok
+}
+
+func (m *BucketMap) seriesFor(id uint32) *BucketedTimeSeries {
+	m.RLock()
+	defer m.RUnlock()
+	return m.rows[id]
+}
+
+func (m *BucketMap) bucketOf(timestamp int64) uint32 {
+	return uint32(timestamp) / m.bucketSize
+}
+
+// Put appends dp for key, creating the series on first write, and
+// returns (1, 1) on success. It returns (NOT_OWNED, NOT_OWNED) if the
+// shard doesn't currently own writes (see BucketMapState).
+func (m *BucketMap) Put(ctx context.Context, key string, dp TimeValuePair, category uint16,
+	skipStateCheck bool) (int, int, error) {
+
+	if !skipStateCheck && m.GetState() == UNOWNED {
+		return NOT_OWNED, NOT_OWNED, nil
+	}
+
+	id := m.lookupOrCreate(key)
+	return m.putById(ctx, id, dp, category)
+}
+
+// PutByTimeSeriesId is Put for callers that already resolved key to
+// its time series id: WAL replay and Raft snapshot restore, neither
+// of which has (or wants to re-derive) the original key lookup.
+func (m *BucketMap) PutByTimeSeriesId(id uint32, dp TimeValuePair, category uint16) (int, int, error) {
+	m.Lock()
+	if _, ok := m.rows[id]; !ok {
+		series := NewBucketedTimeSeries()
+		series.Reset(m.numBuckets)
+		m.rows[id] = series
+		m.persistedSegment[id] = 0
+		if key, ok := m.keys[id]; ok {
+			m.ids[key] = id
+		}
+	}
+	m.Unlock()
+	return m.putById(context.Background(), id, dp, category)
+}
+
+func (m *BucketMap) putById(ctx context.Context, id uint32, dp TimeValuePair, category uint16) (int, int, error) {
+	series := m.seriesFor(id)
+	if series == nil {
+		return 0, 0, fmt.Errorf("tsdb: unknown time series id %d", id)
+	}
+
+	cat := category
+	rolled, err := series.Put(ctx, m.bucketOf(dp.Timestamp), id,
+		&pb.TimeValuePair{Timestamp: dp.Timestamp, Value: dp.Value}, m.storage, &cat)
+	if err != nil {
+		return 0, 0, err
+	}
+	if rolled {
+		m.notePersisted(id)
+	}
+	return 1, 1, nil
+}
+
+// notePersisted records that id just sealed a bucket as of the WAL's
+// current segment, then truncates any segment that's now behind
+// every series in the shard. A single series rolling its own bucket
+// can no longer wipe the WAL for series that haven't caught up yet:
+// truncation only ever advances to the minimum across all of them.
+func (m *BucketMap) notePersisted(id uint32) {
+	if m.wal == nil {
+		return
+	}
+
+	seg := m.wal.CurrentSegmentId()
+
+	m.walMu.Lock()
+	m.persistedSegment[id] = seg
+	min := seg
+	for _, s := range m.persistedSegment {
+		if s < min {
+			min = s
+		}
+	}
+	m.walMu.Unlock()
+
+	if err := m.wal.TruncateBefore(min); err != nil {
+		glog.Errorf("bucketmap: shard %d: truncate wal before segment %d: %v", m.shardId, min, err)
+	}
+}
+
+// Get reads [begin, end] for key under ctx, filtering out anything
+// covered by an active tombstone.
+func (m *BucketMap) Get(ctx context.Context, key string, begin, end uint32, tombstones *TombstoneLog) ([]*TimeSeriesBlock, error) {
+	id, ok := m.LookupTimeSeriesId(key)
+	if !ok {
+		return nil, fmt.Errorf("key not exit")
+	}
+	series := m.seriesFor(id)
+	if series == nil {
+		return nil, fmt.Errorf("key not exit")
+	}
+
+	out, err := series.Get(ctx, begin, end, id, m.storage, tombstones)
+	if m.metrics != nil {
+		m.metrics.observeQueried(series.GetQueriedBucketsAgo())
+	}
+	series.SetQueried()
+	return out, err
+}
+
+// GetLocal is Get without request-scoped cancellation or tombstone
+// filtering, used by a Raft replica answering from its own state.
+func (m *BucketMap) GetLocal(key string, begin, end uint32) ([]*TimeSeriesBlock, error) {
+	return m.Get(context.Background(), key, begin, end, nil)
+}
+
+// minSealedBucket returns the oldest bucket every series in the shard
+// has sealed past - the smallest current_ across all of them, since a
+// series can't have persisted anything at or after its own current_.
+func (m *BucketMap) minSealedBucket() uint32 {
+	m.RLock()
+	rows := make([]*BucketedTimeSeries, 0, len(m.rows))
+	for _, s := range m.rows {
+		rows = append(rows, s)
+	}
+	m.RUnlock()
+
+	min := ^uint32(0)
+	for _, s := range rows {
+		if c := s.CurrentBucket(); c < min {
+			min = c
+		}
+	}
+	if min == ^uint32(0) {
+		return 0
+	}
+	return min
+}
+
+// SealedRangesForLevel returns at most one BucketRange of spanBuckets
+// sealed buckets ready to merge into a level-`level` block: the next
+// span-sized window past whatever this level has already compacted,
+// once every series has sealed all the way through it.
+func (m *BucketMap) SealedRangesForLevel(level int, spanBuckets uint32) []BucketRange {
+	sealedUpTo := m.minSealedBucket()
+
+	m.compactMu.Lock()
+	start := m.compactedUpTo[level]
+	m.compactMu.Unlock()
+
+	if sealedUpTo < start+spanBuckets {
+		return nil
+	}
+	return []BucketRange{{Begin: start, End: start + spanBuckets - 1}}
+}
+
+// SwapBlockRange merges every series' blocks covering r into one new
+// block at level, atomically repointing that series' ring slots at
+// it, and returns the superseded block ids for the caller to release
+// via storage.DeleteBlock once it's done using them.
+func (m *BucketMap) SwapBlockRange(ctx context.Context, r BucketRange, level int,
+	tombstones *TombstoneLog) ([]uint64, error) {
+
+	m.RLock()
+	ids := make([]uint32, 0, len(m.rows))
+	rows := make([]*BucketedTimeSeries, 0, len(m.rows))
+	for id, s := range m.rows {
+		ids = append(ids, id)
+		rows = append(rows, s)
+	}
+	m.RUnlock()
+
+	n := uint32(m.storage.NumBuckets())
+	var oldBlockIds []uint64
+	mergedCount := 0
+
+	for i, series := range rows {
+		blockIds := series.BlockIdsInRange(r.Begin, r.End, n)
+		if len(blockIds) == 0 {
+			continue
+		}
+
+		newId, err := m.storage.Merge(ctx, r.Begin, blockIds, ids[i], level, tombstones)
+		if err != nil {
+			return oldBlockIds, err
+		}
+
+		// Repoint this series' slots under its own write lock before
+		// anything is unlinked, so a concurrent Get never sees a gap.
+		series.SetMergedBlock(r.Begin, r.End, n, newId)
+		oldBlockIds = append(oldBlockIds, blockIds...)
+		mergedCount++
+	}
+
+	m.compactMu.Lock()
+	m.compactedUpTo[level] = r.End + 1
+	m.blocksAtLevel[level] += mergedCount
+	blocks := m.blocksAtLevel[level]
+	m.compactMu.Unlock()
+
+	if m.metrics != nil {
+		m.metrics.setBlocksAtLevel(level, blocks)
+	}
+	return oldBlockIds, nil
+}
+
+// CompactedUpTo returns the first bucket not yet compacted at level,
+// i.e. everything before it has already been folded into a merged
+// block. Used to decide when a tombstone is safe to drop: see
+// TombstoneLog.TruncateBefore.
+func (m *BucketMap) CompactedUpTo(level int) uint32 {
+	m.compactMu.Lock()
+	defer m.compactMu.Unlock()
+	return m.compactedUpTo[level]
+}
+
+// BucketSize returns the shard's bucket width in seconds, so a caller
+// outside BucketMap can translate a timestamp into a bucket number.
+func (m *BucketMap) BucketSize() uint32 { return m.bucketSize }
+
+// DropBefore enforces a retention cutoff across every series in the
+// shard, releasing any block older than cutoff back to storage.
+func (m *BucketMap) DropBefore(cutoff uint32, storage *BucketStorage) error {
+	m.RLock()
+	seriesList := make([]*BucketedTimeSeries, 0, len(m.rows))
+	for _, s := range m.rows {
+		seriesList = append(seriesList, s)
+	}
+	m.RUnlock()
+
+	for _, s := range seriesList {
+		if err := s.DropBefore(cutoff, storage); err != nil {
+			return err
+		}
+	}
+	return nil
+}
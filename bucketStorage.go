@@ -0,0 +1,204 @@
+// On-disk block storage for sealed buckets. BucketedTimeSeries.open
+// calls Store once a bucket rolls and keeps the returned block id;
+// Get calls Fetch to read it back. Kept as its own file (rather than
+// folded into BucketMap) because it only knows about bytes and block
+// ids, never about series or keys.
+package tsdb
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	pb "github.com/huangaz/tsdb/protobuf"
+)
+
+const blockDirName = "blocks"
+
+// BucketStorage owns the block files for a single shard. A block id
+// of INVALID_ID always means "nothing stored for this slot yet".
+type BucketStorage struct {
+	mu sync.Mutex
+
+	dir         string
+	numBuckets  uint8
+	nextBlockId uint64
+
+	// refs counts in-flight Fetch callers per block id, so a
+	// concurrent DeleteBlock (from the reaper or the compactor) can't
+	// unlink a file a reader still has open; it defers the unlink
+	// instead, see release.
+	refs          map[uint64]int
+	pendingDelete map[uint64]bool
+
+	metrics *metricsHooks
+}
+
+// NewBucketStorage creates the block directory for shardId under
+// dataDirectory if it doesn't already exist.
+func NewBucketStorage(dataDirectory string, shardId int64, numBuckets uint8,
+	metrics *metricsHooks) (*BucketStorage, error) {
+
+	dir := filepath.Join(dataDirectory, fmt.Sprintf("%d", shardId), blockDirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &BucketStorage{
+		dir:           dir,
+		numBuckets:    numBuckets,
+		refs:          make(map[uint64]int),
+		pendingDelete: make(map[uint64]bool),
+		metrics:       metrics,
+	}, nil
+}
+
+func (s *BucketStorage) NumBuckets() uint8 { return s.numBuckets }
+
+// Directory returns the shard's block directory, used by raft.go to
+// point a Raft snapshot at the files already on disk.
+func (s *BucketStorage) Directory() string { return s.dir }
+
+func (s *BucketStorage) blockPath(id uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("block-%020d", id))
+}
+
+// Store persists count samples of stream for timeSeriesId's bucket
+// and returns the new block id.
+func (s *BucketStorage) Store(ctx context.Context, bucket uint32, stream []byte, count uint16,
+	timeSeriesId uint32) (uint64, error) {
+
+	ctx, span := startSpan(ctx, "BucketStorage.Store")
+	defer span.End()
+	_ = ctx
+
+	start := time.Now()
+
+	s.mu.Lock()
+	s.nextBlockId++
+	id := s.nextBlockId
+	s.mu.Unlock()
+
+	if err := ioutil.WriteFile(s.blockPath(id), stream, 0644); err != nil {
+		return INVALID_ID, err
+	}
+
+	if s.metrics != nil {
+		s.metrics.observeStore(len(stream), time.Since(start).Seconds())
+	}
+	return id, nil
+}
+
+// Fetch reads back the samples and count stored under blockId. A
+// blockId of INVALID_ID means nothing was ever stored for bucket.
+func (s *BucketStorage) Fetch(ctx context.Context, bucket uint32, blockId uint64) ([]*pb.TimeValuePair, uint16, error) {
+	ctx, span := startSpan(ctx, "BucketStorage.Fetch")
+	defer span.End()
+	_ = ctx
+
+	if blockId == INVALID_ID {
+		return nil, 0, fmt.Errorf("tsdb: no block stored for bucket %d", bucket)
+	}
+
+	start := time.Now()
+	s.retain(blockId)
+	defer s.release(blockId)
+
+	data, err := ioutil.ReadFile(s.blockPath(blockId))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	points := NewSeries(data).ReadData()
+	if s.metrics != nil {
+		s.metrics.observeFetch(len(data), time.Since(start).Seconds())
+	}
+	return points, uint16(len(points)), nil
+}
+
+func (s *BucketStorage) retain(id uint64) {
+	s.mu.Lock()
+	s.refs[id]++
+	s.mu.Unlock()
+}
+
+func (s *BucketStorage) release(id uint64) {
+	s.mu.Lock()
+	s.refs[id]--
+	shouldDelete := s.refs[id] <= 0 && s.pendingDelete[id]
+	if shouldDelete {
+		delete(s.refs, id)
+		delete(s.pendingDelete, id)
+	}
+	s.mu.Unlock()
+
+	if shouldDelete {
+		os.Remove(s.blockPath(id))
+	}
+}
+
+// Merge combines blockIds (all belonging to timeSeriesId, covering
+// bucket begin's range) into one new block at the given compaction
+// level, dropping any sample an active tombstone covers so a delete
+// is folded in for free instead of needing a separate rewrite pass.
+// It returns the new block's id; blockIds themselves are left on disk
+// for the caller to release via DeleteBlock once it has atomically
+// swapped every reference to them over to the new id.
+func (s *BucketStorage) Merge(ctx context.Context, begin uint32, blockIds []uint64, timeSeriesId uint32,
+	level int, tombstones *TombstoneLog) (uint64, error) {
+
+	ctx, span := startSpan(ctx, "BucketStorage.Merge")
+	defer span.End()
+
+	var merged []*pb.TimeValuePair
+	for _, id := range blockIds {
+		if id == INVALID_ID {
+			continue
+		}
+		points, _, err := s.Fetch(ctx, begin, id)
+		if err != nil {
+			return INVALID_ID, err
+		}
+		for _, dp := range points {
+			if tombstones != nil && tombstones.Covers(timeSeriesId, dp.Timestamp) {
+				continue
+			}
+			merged = append(merged, dp)
+		}
+	}
+
+	series := NewSeries(nil)
+	series.Reset()
+	for _, dp := range merged {
+		if err := series.Append(dp.Timestamp, dp.Value, TSDBConf.MinTimestampDelta); err != nil {
+			return INVALID_ID, err
+		}
+	}
+
+	return s.Store(ctx, begin, series.Bs.Stream, uint16(len(merged)), timeSeriesId)
+}
+
+// DeleteBlock removes blockId's file once every in-flight Fetch for
+// it has returned; if one is still running, the unlink is deferred
+// until that Fetch's release() runs instead of racing it.
+func (s *BucketStorage) DeleteBlock(id uint64) error {
+	if id == INVALID_ID {
+		return nil
+	}
+
+	s.mu.Lock()
+	if s.refs[id] > 0 {
+		s.pendingDelete[id] = true
+		s.mu.Unlock()
+		return nil
+	}
+	s.mu.Unlock()
+
+	if err := os.Remove(s.blockPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
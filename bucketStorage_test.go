@@ -0,0 +1,97 @@
+package tsdb
+
+import (
+	"context"
+	"os"
+	"testing"
+)
+
+// TestBucketStorageDeleteBlockDefersUntilReaderDone guards the
+// concurrent-reader bug flagged in review: a DeleteBlock racing a
+// Fetch must not unlink the file out from under it.
+func TestBucketStorageDeleteBlockDefersUntilReaderDone(t *testing.T) {
+	dir, err := os.MkdirTemp("", "bucket_storage_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewBucketStorage(dir, 1, 6, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	series := NewSeries(nil)
+	series.Reset()
+	if err := series.Append(100, 1.5, TSDBConf.MinTimestampDelta); err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := s.Store(context.Background(), 0, series.Bs.Stream, 1, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a Fetch that's still in flight when a delete comes in.
+	s.retain(id)
+
+	if err := s.DeleteBlock(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(s.blockPath(id)); err != nil {
+		t.Fatalf("block file removed while a reader still held it: %v", err)
+	}
+
+	// Once the reader releases its reference, the deferred delete runs.
+	s.release(id)
+	if _, err := os.Stat(s.blockPath(id)); !os.IsNotExist(err) {
+		t.Fatalf("expected block file to be removed after release, stat err = %v", err)
+	}
+}
+
+// TestBucketStorageMergeDropsTombstonedSamples verifies that Merge
+// filters out samples covered by an active tombstone instead of
+// carrying them into the new merged block.
+func TestBucketStorageMergeDropsTombstonedSamples(t *testing.T) {
+	dir, err := os.MkdirTemp("", "bucket_storage_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewBucketStorage(dir, 1, 6, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	series := NewSeries(nil)
+	series.Reset()
+	if err := series.Append(100, 1.5, TSDBConf.MinTimestampDelta); err != nil {
+		t.Fatal(err)
+	}
+	if err := series.Append(200, 2.5, TSDBConf.MinTimestampDelta); err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := s.Store(context.Background(), 0, series.Bs.Stream, 2, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tombstones := &TombstoneLog{byId: map[uint32][]Tombstone{
+		42: {{TimeSeriesId: 42, MinT: 90, MaxT: 110}},
+	}}
+
+	mergedId, err := s.Merge(context.Background(), 0, []uint64{id}, 42, 1, tombstones)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	points, count, err := s.Fetch(context.Background(), 0, mergedId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 || len(points) != 1 || points[0].Timestamp != 200 {
+		t.Fatalf("expected only the non-tombstoned sample at 200 to survive, got %+v", points)
+	}
+}
@@ -2,6 +2,7 @@
 package tsdb
 
 import (
+	"context"
 	"errors"
 	"math"
 	"sync"
@@ -53,9 +54,19 @@ func (b *BucketedTimeSeries) Reset(n uint8) {
 // Open the next bucket for writes, copy out the current active data.
 // `next`: the number of next bucket
 // `storage`: store current active data
-func (b *BucketedTimeSeries) open(next, timeSeriesId uint32,
+//
+// Persisting a bucket here doesn't by itself make any WAL record
+// redundant shard-wide: this series rolling past a bucket says
+// nothing about whether every other series sharing the shard's WAL
+// has done the same. Truncation is coordinated at the BucketMap level
+// instead (see BucketMap.notePersisted), which is why open no longer
+// takes a *WAL.
+func (b *BucketedTimeSeries) open(ctx context.Context, next, timeSeriesId uint32,
 	storage *BucketStorage) (err error) {
 
+	ctx, span := startSpan(ctx, "BucketedTimeSeries.open")
+	defer span.End()
+
 	if b.current_ == 0 {
 		// Skip directly to the new value.
 		b.current_ = next
@@ -65,9 +76,12 @@ func (b *BucketedTimeSeries) open(next, timeSeriesId uint32,
 	var blockId uint64
 	// Wipe all the blocks in between.
 	for b.current_ != next {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		if b.count_ > 0 {
 			// Copy out the active data.
-			blockId, err = storage.Store(b.current_, b.stream_.Bs.Stream, b.count_,
+			blockId, err = storage.Store(ctx, b.current_, b.stream_.Bs.Stream, b.count_,
 				timeSeriesId)
 			if err != nil {
 				return err
@@ -93,26 +107,35 @@ func (b *BucketedTimeSeries) open(next, timeSeriesId uint32,
 // If category pointer is defined, sets the category.
 // `i`: the number of bucket to store data
 // `dp`: data point to be stored
-func (b *BucketedTimeSeries) Put(i, timeSeriesId uint32, dp *pb.TimeValuePair,
-	storage *BucketStorage, category *uint16) (err error) {
+// Returns whether writing dp rolled the active bucket forward, so
+// callers that coordinate WAL truncation across series (BucketMap)
+// know when to re-check their low-watermark.
+func (b *BucketedTimeSeries) Put(ctx context.Context, i, timeSeriesId uint32, dp *pb.TimeValuePair,
+	storage *BucketStorage, category *uint16) (rolled bool, err error) {
+
+	ctx, span := startSpan(ctx, "BucketedTimeSeries.Put")
+	defer span.End()
+
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
 
 	b.Lock()
 	defer b.Unlock()
 
 	if i < b.current_ {
-		return errors.New("Invalid bucket number!")
+		return false, errors.New("Invalid bucket number!")
 	}
 
 	if i > b.current_ {
-		err = b.open(i, timeSeriesId, storage)
-		if err != nil {
-			return err
+		if err := b.open(ctx, i, timeSeriesId, storage); err != nil {
+			return false, err
 		}
+		rolled = true
 	}
 
-	err = b.stream_.Append(dp.Timestamp, dp.Value, TSDBConf.MinTimestampDelta)
-	if err != nil {
-		return err
+	if err := b.stream_.Append(dp.Timestamp, dp.Value, TSDBConf.MinTimestampDelta); err != nil {
+		return rolled, err
 	}
 
 	if category != nil {
@@ -120,12 +143,20 @@ func (b *BucketedTimeSeries) Put(i, timeSeriesId uint32, dp *pb.TimeValuePair,
 	}
 
 	b.count_++
-	return nil
+	return rolled, nil
 }
 
-// Read out buckets between begin and end inclusive, including current one.
-func (b *BucketedTimeSeries) Get(begin, end uint32,
-	storage *BucketStorage) (out []*TimeSeriesBlock, err error) {
+// Read out buckets between begin and end inclusive, including current
+// one. If ctx is cancelled partway through, the blocks fetched so far
+// are returned alongside ctx.Err() instead of blocking on the rest.
+// Samples covered by an active tombstone for timeSeriesId are dropped
+// from the result without touching the stored blocks themselves;
+// tombstones may be nil to skip filtering.
+func (b *BucketedTimeSeries) Get(ctx context.Context, begin, end, timeSeriesId uint32,
+	storage *BucketStorage, tombstones *TombstoneLog) (out []*TimeSeriesBlock, err error) {
+
+	ctx, span := startSpan(ctx, "BucketedTimeSeries.Get")
+	defer span.End()
 
 	n := storage.NumBuckets()
 
@@ -148,8 +179,12 @@ func (b *BucketedTimeSeries) Get(begin, end uint32,
 
 	// Read data.
 	for i := begin; i <= end; i++ {
+		if err := ctx.Err(); err != nil {
+			return out, err
+		}
+
 		outBlock := &TimeSeriesBlock{}
-		outBlock.Data, outBlock.Count, err = storage.Fetch(i, b.blocks_[i%uint32(n)])
+		outBlock.Data, outBlock.Count, err = storage.Fetch(ctx, i, b.blocks_[i%uint32(n)])
 		/*
 			if err != nil {
 				return nil, err
@@ -157,6 +192,7 @@ func (b *BucketedTimeSeries) Get(begin, end uint32,
 			out = append(out, outBlock)
 		*/
 		if err == nil {
+			filterTombstoned(outBlock, timeSeriesId, tombstones)
 			out = append(out, outBlock)
 		}
 	}
@@ -165,22 +201,41 @@ func (b *BucketedTimeSeries) Get(begin, end uint32,
 		outBlock := &TimeSeriesBlock{}
 		outBlock.Count = b.count_
 		outBlock.Data = b.stream_.ReadData()
+		filterTombstoned(outBlock, timeSeriesId, tombstones)
 		out = append(out, outBlock)
 	}
 
 	return out, nil
 }
 
+// filterTombstoned drops any sample in block whose timestamp falls
+// inside an active tombstone for timeSeriesId, in place.
+func filterTombstoned(block *TimeSeriesBlock, timeSeriesId uint32, tombstones *TombstoneLog) {
+	if tombstones == nil || len(block.Data) == 0 {
+		return
+	}
+
+	kept := block.Data[:0]
+	for _, dp := range block.Data {
+		if tombstones.Covers(timeSeriesId, dp.Timestamp) {
+			continue
+		}
+		kept = append(kept, dp)
+	}
+	block.Data = kept
+	block.Count = uint16(len(kept))
+}
+
 // Sets the current bucket. Flushes data from the previous bucket to
 // BucketStorage. No-op if this time series is already at currentBucket.
-func (b *BucketedTimeSeries) SetCurrentBucket(currentBucket, timeSeriesId uint32,
+func (b *BucketedTimeSeries) SetCurrentBucket(ctx context.Context, currentBucket, timeSeriesId uint32,
 	storage *BucketStorage) (err error) {
 
 	b.Lock()
 	defer b.Unlock()
 
 	if b.current_ < currentBucket {
-		err = b.open(currentBucket, timeSeriesId, storage)
+		err = b.open(ctx, currentBucket, timeSeriesId, storage)
 		if err != nil {
 			return err
 		}
@@ -188,6 +243,73 @@ func (b *BucketedTimeSeries) SetCurrentBucket(currentBucket, timeSeriesId uint32
 	return nil
 }
 
+// CurrentBucket returns the bucket currently open for writes.
+func (b *BucketedTimeSeries) CurrentBucket() uint32 {
+	b.RLock()
+	defer b.RUnlock()
+	return b.current_
+}
+
+// DropBefore clears any block references older than bucket and asks
+// storage to release the underlying files, enforcing a retention
+// policy's cutoff without touching the still-live blocks_ entries.
+func (b *BucketedTimeSeries) DropBefore(bucket uint32, storage *BucketStorage) error {
+	b.Lock()
+	defer b.Unlock()
+
+	n := uint32(storage.NumBuckets())
+	for i := range b.blocks_ {
+		id := b.blocks_[i]
+		if id == INVALID_ID {
+			continue
+		}
+		// blocks_ is a ring buffer keyed by bucket % n; recover which
+		// bucket this slot last held relative to the active one. b.current_
+		// itself is still open for writes and holds no block, so the most
+		// recent sealed bucket in any slot is b.current_-1, not b.current_:
+		// using b.current_ here would make slot (b.current_ % n) resolve
+		// to the active bucket instead of the sealed one n buckets back.
+		slotBucket := b.current_ - 1 - ((b.current_ - 1 - uint32(i)) % n)
+		if slotBucket >= bucket {
+			continue
+		}
+		if err := storage.DeleteBlock(id); err != nil {
+			return err
+		}
+		b.blocks_[i] = INVALID_ID
+	}
+	return nil
+}
+
+// BlockIdsInRange returns the distinct, non-empty block ids assigned
+// to buckets [begin, end] for this series, for a Compactor to merge.
+func (b *BucketedTimeSeries) BlockIdsInRange(begin, end, numBuckets uint32) []uint64 {
+	b.RLock()
+	defer b.RUnlock()
+
+	seen := make(map[uint64]bool)
+	var ids []uint64
+	for bucket := begin; bucket <= end; bucket++ {
+		id := b.blocks_[bucket%numBuckets]
+		if id == INVALID_ID || seen[id] {
+			continue
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// SetMergedBlock points every slot in [begin, end] at the single
+// block id a compaction pass produced for that range.
+func (b *BucketedTimeSeries) SetMergedBlock(begin, end, numBuckets uint32, id uint64) {
+	b.Lock()
+	defer b.Unlock()
+	for bucket := begin; bucket <= end; bucket++ {
+		b.blocks_[bucket%numBuckets] = id
+	}
+}
+
 // Sets that this time series was just queried.
 func (b *BucketedTimeSeries) SetQueried() {
 	b.queriedBucketsAgo_ = 0
@@ -0,0 +1,167 @@
+package tsdb
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	pb "github.com/huangaz/tsdb/protobuf"
+)
+
+func newTestBucketStorage(t *testing.T, numBuckets uint8) *BucketStorage {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "bucketed_time_series_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	s, err := NewBucketStorage(dir, 1, numBuckets, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestBucketedTimeSeriesPutIntoCurrentBucketDoesNotRoll(t *testing.T) {
+	storage := newTestBucketStorage(t, 6)
+	b := NewBucketedTimeSeries()
+	b.Reset(6)
+
+	rolled, err := b.Put(context.Background(), 0, 1, &pb.TimeValuePair{Timestamp: 100, Value: 1}, storage, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rolled {
+		t.Error("writing into the already-current bucket should not report a roll")
+	}
+
+	rolled, err = b.Put(context.Background(), 0, 1, &pb.TimeValuePair{Timestamp: 200, Value: 2}, storage, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rolled {
+		t.Error("a second write into the still-active bucket should not report a roll")
+	}
+}
+
+func TestBucketedTimeSeriesPutRollsBucketsForwardAndSealsPreviousBucket(t *testing.T) {
+	storage := newTestBucketStorage(t, 6)
+	b := NewBucketedTimeSeries()
+	b.Reset(6)
+
+	if _, err := b.Put(context.Background(), 1, 1, &pb.TimeValuePair{Timestamp: 3600, Value: 1}, storage, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	rolled, err := b.Put(context.Background(), 3, 1, &pb.TimeValuePair{Timestamp: 10800, Value: 2}, storage, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rolled {
+		t.Error("Put targeting a later bucket should report rolled=true")
+	}
+	if b.CurrentBucket() != 3 {
+		t.Errorf("CurrentBucket() = %d, want 3", b.CurrentBucket())
+	}
+
+	// Bucket 1 had data and should have been sealed into storage by the
+	// roll to bucket 3; bucket 2 was skipped over empty and should stay
+	// INVALID_ID.
+	if b.blocks_[1] == INVALID_ID {
+		t.Error("bucket 1 should have been sealed with a real block id")
+	}
+	if b.blocks_[2] != INVALID_ID {
+		t.Error("bucket 2 was never written to and should stay INVALID_ID")
+	}
+}
+
+func TestBucketedTimeSeriesPutRejectsBucketBehindCurrent(t *testing.T) {
+	storage := newTestBucketStorage(t, 6)
+	b := NewBucketedTimeSeries()
+	b.Reset(6)
+
+	if _, err := b.Put(context.Background(), 2, 1, &pb.TimeValuePair{Timestamp: 7300, Value: 1}, storage, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Put(context.Background(), 1, 1, &pb.TimeValuePair{Timestamp: 100, Value: 2}, storage, nil); err == nil {
+		t.Error("Put targeting a bucket before the current one should return an error")
+	}
+}
+
+func TestBucketedTimeSeriesDropBeforeRingMath(t *testing.T) {
+	storage := newTestBucketStorage(t, 3)
+	b := NewBucketedTimeSeries()
+	b.Reset(3)
+
+	// Walk through buckets 1..4 (ring size 3), so the ring wraps: bucket
+	// 4 becomes the active bucket, and the three sealed buckets behind
+	// it (1, 2, 3) land in slots 1, 2, 0 respectively.
+	for bucket := uint32(1); bucket <= 4; bucket++ {
+		if _, err := b.Put(context.Background(), bucket, 1,
+			&pb.TimeValuePair{Timestamp: int64(bucket) * 3600, Value: float64(bucket)}, storage, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	blockAtSlot0 := b.blocks_[0]
+	blockAtSlot1 := b.blocks_[1]
+	blockAtSlot2 := b.blocks_[2]
+	for i, id := range []uint64{blockAtSlot0, blockAtSlot1, blockAtSlot2} {
+		if id == INVALID_ID {
+			t.Fatalf("slot %d unexpectedly empty before DropBefore", i)
+		}
+	}
+
+	// Dropping everything before bucket 3 should clear the slots
+	// holding buckets 1 and 2, but keep slot 0 (bucket 3, not < cutoff).
+	if err := b.DropBefore(3, storage); err != nil {
+		t.Fatal(err)
+	}
+
+	if b.blocks_[0] != blockAtSlot0 {
+		t.Errorf("slot 0 (bucket 3, at the cutoff) should survive DropBefore, got %d want %d", b.blocks_[0], blockAtSlot0)
+	}
+	if b.blocks_[1] != INVALID_ID {
+		t.Errorf("slot 1 (bucket 1, before the cutoff) should have been cleared, got %d", b.blocks_[1])
+	}
+	if b.blocks_[2] != INVALID_ID {
+		t.Errorf("slot 2 (bucket 2, before the cutoff) should have been cleared, got %d", b.blocks_[2])
+	}
+
+	// The dropped block's file should actually be gone from storage.
+	if _, _, err := storage.Fetch(context.Background(), 1, blockAtSlot1); err == nil {
+		t.Error("expected dropped block to be removed from storage")
+	}
+}
+
+func TestBlockIdsInRangeDedupesAndSkipsInvalid(t *testing.T) {
+	b := NewBucketedTimeSeries()
+	b.Reset(4)
+	b.blocks_ = []uint64{5, 5, INVALID_ID, 7}
+
+	got := b.BlockIdsInRange(0, 3, 4)
+	want := []uint64{5, 7}
+	if len(got) != len(want) {
+		t.Fatalf("BlockIdsInRange = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("BlockIdsInRange = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestSetMergedBlockPointsEverySlotAtNewId(t *testing.T) {
+	b := NewBucketedTimeSeries()
+	b.Reset(4)
+	b.blocks_ = []uint64{1, 2, 3, 4}
+
+	b.SetMergedBlock(0, 3, 4, 99)
+
+	for i, id := range b.blocks_ {
+		if id != 99 {
+			t.Errorf("blocks_[%d] = %d, want 99 after SetMergedBlock", i, id)
+		}
+	}
+}
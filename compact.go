@@ -0,0 +1,134 @@
+// Background compaction of adjacent sealed buckets into larger,
+// immutable blocks, modeled after the Prometheus TSDB compactor.
+package tsdb
+
+import (
+	"context"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// compactionLevel describes one step of the exponential range plan:
+// spanBuckets sealed blocks (or blocks from the level below) are merged
+// into a single block at this level.
+type compactionLevel struct {
+	level       int
+	spanBuckets uint32
+}
+
+// DefaultCompactionPlan merges 6 sealed buckets into a level-1 block,
+// then 5 level-1 blocks into a level-2 block, matching the ratios
+// called out for this subsystem.
+var DefaultCompactionPlan = []compactionLevel{
+	{level: 1, spanBuckets: 6},
+	{level: 2, spanBuckets: 5},
+}
+
+// Compactor periodically merges contiguous sealed buckets belonging to
+// a shard's BucketMap into larger block files, so long-lived series
+// don't accumulate one file per bucket forever. Reader-safety for the
+// blocks it supersedes is handled by BucketStorage itself (see
+// BucketStorage.DeleteBlock); the Compactor doesn't track refs of its
+// own.
+type Compactor struct {
+	interval time.Duration
+	plan     []compactionLevel
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewCompactor creates a Compactor that wakes up every interval to
+// look for compactable ranges. Call Start to run it in the background.
+func NewCompactor(interval time.Duration) *Compactor {
+	return &Compactor{
+		interval: interval,
+		plan:     DefaultCompactionPlan,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start runs the periodic compaction loop for shardId against m until
+// Stop is called. It is meant to be started once per shard from
+// TsdbService.Start. tombstones may be nil if the shard has none.
+func (c *Compactor) Start(shardId int64, m *BucketMap, storage *BucketStorage, tombstones *TombstoneLog) {
+	go func() {
+		defer close(c.done)
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-ticker.C:
+				if err := c.compactOnce(shardId, m, storage, tombstones); err != nil {
+					glog.Errorf("compactor: shard %d: %v", shardId, err)
+				}
+			}
+		}
+	}()
+}
+
+// Stop halts the background loop and waits for it to exit.
+func (c *Compactor) Stop() {
+	close(c.stop)
+	<-c.done
+}
+
+// compactOnce walks the compaction plan once, merging any range of
+// sealed blocks that's become eligible since the last pass. Afterwards,
+// any tombstone whose covered range now falls entirely before the
+// lowest level's compacted watermark has been folded into every block
+// it could affect and is truncated from the log; anything more recent
+// is left in place so Get's live filtering keeps catching it.
+func (c *Compactor) compactOnce(shardId int64, m *BucketMap, storage *BucketStorage, tombstones *TombstoneLog) error {
+	ctx, span := startSpan(context.Background(), "Compactor.compactOnce")
+	defer span.End()
+
+	for _, lvl := range c.plan {
+		ranges := m.SealedRangesForLevel(lvl.level, lvl.spanBuckets)
+		for _, r := range ranges {
+			if err := c.compactRange(ctx, m, storage, lvl.level, r, tombstones); err != nil {
+				return err
+			}
+		}
+	}
+
+	if tombstones != nil && len(c.plan) > 0 {
+		cutoff := m.CompactedUpTo(c.plan[0].level)
+		if err := tombstones.TruncateBefore(cutoff, m.BucketSize()); err != nil {
+			glog.Errorf("compactor: shard %d: truncate tombstones before bucket %d: %v", shardId, cutoff, err)
+		}
+	}
+	return nil
+}
+
+// compactRange merges the blocks covering series r into a single
+// level-lvl block, atomically swaps every series' blocks_ entry for
+// that range to point at the merged block, and releases the
+// superseded per-bucket files back to storage - which defers the
+// actual unlink until any Fetch still reading one of them finishes.
+func (c *Compactor) compactRange(ctx context.Context, m *BucketMap, storage *BucketStorage,
+	level int, r BucketRange, tombstones *TombstoneLog) error {
+
+	oldBlockIds, err := m.SwapBlockRange(ctx, r, level, tombstones)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range oldBlockIds {
+		if err := storage.DeleteBlock(id); err != nil {
+			glog.Errorf("compactor: delete superseded block %d: %v", id, err)
+		}
+	}
+	return nil
+}
+
+// BucketRange is an inclusive [Begin, End] span of bucket ids that a
+// Compactor has decided to merge into one block.
+type BucketRange struct {
+	Begin uint32
+	End   uint32
+}
@@ -0,0 +1,276 @@
+// Raft-replicated shards, so writes survive the loss of any one
+// replica. Each shard's BucketMap is driven as a Raft state machine
+// using hashicorp/raft: Put becomes a log append applied to
+// BucketMap.Put on every replica, and snapshots reuse the existing
+// on-disk block files plus a WAL offset rather than a bespoke format.
+package tsdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// ClusterConfig describes the Raft peer set for one shard.
+type ClusterConfig struct {
+	// ShardId identifies which shard this cluster replicates.
+	ShardId int64
+
+	// LocalId is this node's Raft server id.
+	LocalId raft.ServerID
+
+	// LocalAddr is this node's Raft transport address.
+	LocalAddr raft.ServerAddress
+
+	// Peers lists every other replica for the shard at startup. Use
+	// AddPeer/RemovePeer to change membership afterwards.
+	Peers []raft.Server
+}
+
+// raftApplyTimeout bounds how long a leader waits for a Put to commit
+// before giving up and returning an error to the caller.
+const raftApplyTimeout = 5 * time.Second
+
+// PeerClient forwards a write or read to another shard replica, e.g.
+// over the service's existing RPC transport. RaftPeerClient must be
+// set by whoever wires up the cluster before any follower traffic
+// needs forwarding.
+type PeerClient interface {
+	ForwardPut(addr raft.ServerAddress, shardId int64, key string, dp TimeValuePair, category uint16) error
+	ForwardGet(addr raft.ServerAddress, shardId int64, key string, begin, end uint32) ([]*TimeSeriesBlock, error)
+}
+
+var RaftPeerClient PeerClient
+
+// ClusterConfigs optionally enables Raft replication per shard.
+// TsdbService.Start consults it for each shard it owns: a shard with
+// an entry here gets a ShardReplica wired up via NewShardReplica and
+// Put is only acknowledged once the write commits through Raft; a
+// shard with no entry runs unreplicated, exactly as before. Populate
+// this before calling Start.
+var ClusterConfigs = map[int64]ClusterConfig{}
+
+// ShardReplica wraps one shard's BucketMap with a Raft group so Put
+// is only acknowledged once it's replicated to a quorum.
+type ShardReplica struct {
+	mu sync.RWMutex
+
+	shardId int64
+	bucket  *BucketMap
+	storage *BucketStorage
+	wal     *WAL
+
+	raft *raft.Raft
+}
+
+// NewShardReplica starts (or rejoins) the Raft group for cfg.ShardId,
+// backed by m for applying committed entries and storage/wal for
+// snapshotting.
+func NewShardReplica(cfg ClusterConfig, m *BucketMap, storage *BucketStorage, wal *WAL,
+	transport raft.Transport, logStore raft.LogStore, stableStore raft.StableStore,
+	snapshotStore raft.SnapshotStore) (*ShardReplica, error) {
+
+	s := &ShardReplica{
+		shardId: cfg.ShardId,
+		bucket:  m,
+		storage: storage,
+		wal:     wal,
+	}
+
+	raftConfig := raft.DefaultConfig()
+	raftConfig.LocalID = cfg.LocalId
+
+	r, err := raft.NewRaft(raftConfig, (*shardFSM)(s), logStore, stableStore, snapshotStore, transport)
+	if err != nil {
+		return nil, err
+	}
+	s.raft = r
+
+	if len(cfg.Peers) > 0 {
+		servers := append([]raft.Server{{ID: cfg.LocalId, Address: cfg.LocalAddr}}, cfg.Peers...)
+		f := r.BootstrapCluster(raft.Configuration{Servers: servers})
+		if err := f.Error(); err != nil && err != raft.ErrCantBootstrap {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// newLocalShardReplica builds the Raft plumbing (transport, log/stable
+// store, snapshot store) for cfg and starts a ShardReplica on top of
+// it. It's the default wiring TsdbService.Start uses for any shard
+// listed in ClusterConfigs; a deployment that needs durable log/stable
+// stores instead of the in-memory ones can call NewShardReplica
+// directly with its own.
+func newLocalShardReplica(cfg ClusterConfig, m *BucketMap, storage *BucketStorage, wal *WAL) (*ShardReplica, error) {
+	transport, err := raft.NewTCPTransport(string(cfg.LocalAddr), nil, 3, 10*time.Second, os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("raft: shard %d: create transport: %w", cfg.ShardId, err)
+	}
+
+	logStore := raft.NewInmemStore()
+	stableStore := raft.NewInmemStore()
+	snapshotStore := raft.NewInmemSnapshotStore()
+
+	return NewShardReplica(cfg, m, storage, wal, transport, logStore, stableStore, snapshotStore)
+}
+
+// Put replicates dp for key through Raft. On the leader this blocks
+// until the entry commits; on a follower it is forwarded to the
+// current leader.
+func (s *ShardReplica) Put(key string, dp TimeValuePair, category uint16) error {
+	if s.raft.State() != raft.Leader {
+		return s.forwardPut(key, dp, category)
+	}
+
+	cmd := encodeRaftPut(key, dp, category)
+	future := s.raft.Apply(cmd, raftApplyTimeout)
+	if err := future.Error(); err != nil {
+		return err
+	}
+	if err, ok := future.Response().(error); ok && err != nil {
+		return err
+	}
+	return nil
+}
+
+// Get serves a read. staleOk allows a follower to answer from its own
+// state instead of forwarding to the leader, trading linearizability
+// for lower latency.
+func (s *ShardReplica) Get(begin, end uint32, key string, staleOk bool) ([]*TimeSeriesBlock, error) {
+	if !staleOk && s.raft.State() != raft.Leader {
+		return s.forwardGet(begin, end, key)
+	}
+	return s.bucket.GetLocal(key, begin, end)
+}
+
+// forwardPut and forwardGet send the request to whichever peer Raft
+// currently believes is the leader.
+func (s *ShardReplica) forwardPut(key string, dp TimeValuePair, category uint16) error {
+	addr, _ := s.raft.LeaderWithID()
+	if addr == "" || RaftPeerClient == nil {
+		return fmt.Errorf("raft: shard %d has no leader", s.shardId)
+	}
+	return RaftPeerClient.ForwardPut(addr, s.shardId, key, dp, category)
+}
+
+func (s *ShardReplica) forwardGet(begin, end uint32, key string) ([]*TimeSeriesBlock, error) {
+	addr, _ := s.raft.LeaderWithID()
+	if addr == "" || RaftPeerClient == nil {
+		return nil, fmt.Errorf("raft: shard %d has no leader", s.shardId)
+	}
+	return RaftPeerClient.ForwardGet(addr, s.shardId, key, begin, end)
+}
+
+// AddPeer adds a voting member to the shard's Raft group.
+func (s *ShardReplica) AddPeer(id raft.ServerID, addr raft.ServerAddress) error {
+	return s.raft.AddVoter(id, addr, 0, 0).Error()
+}
+
+// RemovePeer removes a member from the shard's Raft group.
+func (s *ShardReplica) RemovePeer(id raft.ServerID) error {
+	return s.raft.RemoveServer(id, 0, 0).Error()
+}
+
+// shardFSM adapts ShardReplica to raft.FSM. It's a distinct named
+// type (rather than methods on ShardReplica itself) so the Raft log
+// application surface stays separate from the client-facing API.
+type shardFSM ShardReplica
+
+func (f *shardFSM) Apply(entry *raft.Log) interface{} {
+	key, dp, category, err := decodeRaftPut(entry.Data)
+	if err != nil {
+		return err
+	}
+	_, _, err = f.bucket.Put(context.Background(), key, dp, category, false)
+	return err
+}
+
+// Snapshot reuses the shard's existing on-disk block files rather
+// than serializing state separately: a Raft snapshot is just a
+// pointer to those files plus the WAL offset at the time it was
+// taken, replayed the same way Start() replays the WAL on a cold boot.
+func (f *shardFSM) Snapshot() (raft.FSMSnapshot, error) {
+	return &shardSnapshot{
+		shardId:   f.shardId,
+		blockDir:  f.storage.Directory(),
+		walOffset: f.wal.Offset(),
+	}, nil
+}
+
+func (f *shardFSM) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	snap, err := decodeShardSnapshot(rc)
+	if err != nil {
+		return err
+	}
+	if err := f.bucket.ReadBlockFilesFrom(snap.blockDir); err != nil {
+		return err
+	}
+	// snap.walOffset records where the WAL stood when this snapshot was
+	// taken, but it isn't a safe lower bound to start replay from:
+	// BucketMap.notePersisted/WAL.TruncateBefore already delete any
+	// segment once every series has rolled past it, so whatever segment
+	// is current at snapshot time can still hold not-yet-sealed data
+	// for a series that hasn't rolled its active bucket yet. Replaying
+	// everything still on disk is what keeps that data from being lost;
+	// the truncation invariant is what keeps this from being expensive.
+	return ReplayWAL(f.storage.Directory(), f.shardId, func(rec *WalRecord) error {
+		_, _, err := f.bucket.PutByTimeSeriesId(rec.TimeSeriesId, TimeValuePair{
+			Value: rec.Value, Timestamp: rec.Timestamp}, rec.Category)
+		return err
+	})
+}
+
+type shardSnapshot struct {
+	shardId   int64
+	blockDir  string
+	walOffset int64
+}
+
+func (s *shardSnapshot) Persist(sink raft.SnapshotSink) error {
+	_, err := fmt.Fprintf(sink, "%d\n%s\n%d\n", s.shardId, s.blockDir, s.walOffset)
+	if err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *shardSnapshot) Release() {}
+
+func decodeShardSnapshot(r io.Reader) (*shardSnapshot, error) {
+	snap := &shardSnapshot{}
+	_, err := fmt.Fscanf(r, "%d\n%s\n%d\n", &snap.shardId, &snap.blockDir, &snap.walOffset)
+	return snap, err
+}
+
+// raftPutCmd is the gob-encoded payload of a Raft log entry for Put.
+type raftPutCmd struct {
+	Key      string
+	Dp       TimeValuePair
+	Category uint16
+}
+
+func encodeRaftPut(key string, dp TimeValuePair, category uint16) []byte {
+	var buf bytes.Buffer
+	// A command this small is never expected to fail to encode.
+	_ = gob.NewEncoder(&buf).Encode(raftPutCmd{Key: key, Dp: dp, Category: category})
+	return buf.Bytes()
+}
+
+func decodeRaftPut(data []byte) (key string, dp TimeValuePair, category uint16, err error) {
+	var cmd raftPutCmd
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&cmd); err != nil {
+		return "", TimeValuePair{}, 0, err
+	}
+	return cmd.Key, cmd.Dp, cmd.Category, nil
+}
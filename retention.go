@@ -0,0 +1,206 @@
+// Time-based retention, enforced per shard on top of the fixed
+// bucket-count window BucketedTimeSeries already keeps.
+package tsdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const retentionFileName = "retention"
+
+// RetentionPolicy bounds how much history a shard keeps, by wall-clock
+// duration, by bucket count, or both. A zero Duration/MaxBuckets means
+// "no limit on this axis".
+type RetentionPolicy struct {
+	// Duration is how long a point is kept after it was written.
+	Duration time.Duration
+
+	// MaxBuckets caps how many sealed buckets are retained, same as
+	// the `n` historical buckets BucketedTimeSeries.Reset already
+	// allows, but enforced independently of bucket count on rotation.
+	MaxBuckets uint8
+
+	// MinTime is the oldest timestamp Put currently accepts. It's
+	// recomputed from Duration and MaxBuckets each time the reaper
+	// runs (see Reaper.reapOnce) and persisted back alongside the
+	// rest of the policy, so Put can check it directly instead of
+	// redoing the cutoffBucket math on every write.
+	MinTime int64
+}
+
+// ErrBeforeRetention is returned by Put when a sample's timestamp
+// falls before the shard's current retention window.
+var ErrBeforeRetention = fmt.Errorf("tsdb: timestamp before retention window")
+
+// retentionPolicy wire format: [8 bytes duration seconds][1 byte max
+// buckets][8 bytes min time]. There's no shared proto message for this
+// (unlike Tombstone, RetentionPolicy is local to this shard's own
+// bookkeeping, not something another service decodes), so it's encoded
+// by hand the same way tombstone.go encodes Tombstone.
+const retentionPolicyLen = 8 + 1 + 8
+
+// marshalRetentionPolicy encodes policy for persisting next to the
+// shard's key list.
+func marshalRetentionPolicy(policy RetentionPolicy) ([]byte, error) {
+	buf := make([]byte, retentionPolicyLen)
+	binary.BigEndian.PutUint64(buf[0:8], uint64(policy.Duration/time.Second))
+	buf[8] = byte(policy.MaxBuckets)
+	binary.BigEndian.PutUint64(buf[9:17], uint64(policy.MinTime))
+	return buf, nil
+}
+
+func unmarshalRetentionPolicy(data []byte) (RetentionPolicy, error) {
+	if len(data) != retentionPolicyLen {
+		return RetentionPolicy{}, fmt.Errorf("tsdb: corrupt retention policy: want %d bytes, got %d",
+			retentionPolicyLen, len(data))
+	}
+	return RetentionPolicy{
+		Duration:   time.Duration(binary.BigEndian.Uint64(data[0:8])) * time.Second,
+		MaxBuckets: uint8(data[8]),
+		MinTime:    int64(binary.BigEndian.Uint64(data[9:17])),
+	}, nil
+}
+
+func retentionPath(dataDirectory string, shardId int64) string {
+	return filepath.Join(dataDirectory, fmt.Sprintf("%d", shardId), retentionFileName)
+}
+
+// WriteRetentionPolicy durably persists policy for shardId, next to
+// the shard's key list.
+func WriteRetentionPolicy(dataDirectory string, shardId int64, policy RetentionPolicy) error {
+	data, err := marshalRetentionPolicy(policy)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(retentionPath(dataDirectory, shardId), data, 0644)
+}
+
+// ReadRetentionPolicy loads a previously persisted policy, or the zero
+// value (no limits) if none was ever set for this shard.
+func ReadRetentionPolicy(dataDirectory string, shardId int64) (RetentionPolicy, error) {
+	data, err := ioutil.ReadFile(retentionPath(dataDirectory, shardId))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return RetentionPolicy{}, nil
+		}
+		return RetentionPolicy{}, err
+	}
+	return unmarshalRetentionPolicy(data)
+}
+
+// cutoffBucket returns the oldest bucket id that policy still allows,
+// given the current time and the configured bucket size. Duration and
+// MaxBuckets are independent limits; the returned cutoff is whichever
+// one is more restrictive (the later/bigger bucket id), matching
+// RetentionPolicy's doc comment that either axis can apply.
+func cutoffBucket(policy RetentionPolicy, now time.Time, bucketSize uint32) uint32 {
+	var cutoff uint32
+
+	if policy.Duration > 0 {
+		if d := now.Add(-policy.Duration).Unix(); d > 0 {
+			cutoff = uint32(d) / bucketSize
+		}
+	}
+
+	if policy.MaxBuckets > 0 {
+		current := uint32(now.Unix()) / bucketSize
+		if current > uint32(policy.MaxBuckets) {
+			if fromCount := current - uint32(policy.MaxBuckets); fromCount > cutoff {
+				cutoff = fromCount
+			}
+		}
+	}
+
+	return cutoff
+}
+
+// EffectiveMinTime returns the oldest timestamp currently acceptable
+// under policy: MinTime if the reaper has already computed one,
+// otherwise cutoffBucket's answer for right now. Put uses this so a
+// freshly-set policy is enforced immediately rather than waiting for
+// the next reap pass to populate MinTime.
+func (p RetentionPolicy) EffectiveMinTime(now time.Time, bucketSize uint32) int64 {
+	if p.MinTime > 0 {
+		return p.MinTime
+	}
+	if p.Duration <= 0 && p.MaxBuckets == 0 {
+		return 0
+	}
+	return int64(cutoffBucket(p, now, bucketSize)) * int64(bucketSize)
+}
+
+// Reaper periodically walks every shard's BucketMap and drops data
+// that has aged out of its RetentionPolicy.
+type Reaper struct {
+	interval time.Duration
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewReaper creates a Reaper that sweeps every interval.
+func NewReaper(interval time.Duration) *Reaper {
+	return &Reaper{
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start runs the periodic reap loop for shardId against m until Stop
+// is called. load reads the shard's current RetentionPolicy and save
+// persists it back once reapOnce has recomputed MinTime, so the next
+// load (and every Put in between) sees an up to date cutoff without
+// recomputing it from scratch.
+func (r *Reaper) Start(shardId int64, m *BucketMap, storage *BucketStorage,
+	load func() RetentionPolicy, save func(RetentionPolicy)) {
+
+	go func() {
+		defer close(r.done)
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-ticker.C:
+				updated, err := r.reapOnce(shardId, m, storage, load())
+				if err != nil {
+					glog.Errorf("reaper: shard %d: %v", shardId, err)
+					continue
+				}
+				save(updated)
+			}
+		}
+	}()
+}
+
+// Stop halts the background loop and waits for it to exit.
+func (r *Reaper) Stop() {
+	close(r.stop)
+	<-r.done
+}
+
+// reapOnce drops everything before policy's cutoff and returns policy
+// with MinTime updated to match, for the caller to persist.
+func (r *Reaper) reapOnce(shardId int64, m *BucketMap, storage *BucketStorage,
+	policy RetentionPolicy) (RetentionPolicy, error) {
+
+	if policy.Duration <= 0 && policy.MaxBuckets == 0 {
+		return policy, nil
+	}
+
+	cutoff := cutoffBucket(policy, time.Now(), TSDBConf.BucketSize)
+	if err := m.DropBefore(cutoff, storage); err != nil {
+		return policy, err
+	}
+
+	policy.MinTime = int64(cutoff) * int64(TSDBConf.BucketSize)
+	return policy, nil
+}
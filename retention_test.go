@@ -0,0 +1,68 @@
+package tsdb
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCutoffBucketHonorsMaxBuckets(t *testing.T) {
+	const bucketSize = 3600 // 1 hour
+	now := time.Unix(1000*bucketSize, 0)
+
+	// MaxBuckets alone: cutoff should be current-MaxBuckets, with no
+	// Duration-based cutoff competing.
+	policy := RetentionPolicy{MaxBuckets: 10}
+	got := cutoffBucket(policy, now, bucketSize)
+	want := uint32(1000 - 10)
+	if got != want {
+		t.Errorf("cutoffBucket(MaxBuckets=10) = %d, want %d", got, want)
+	}
+}
+
+func TestCutoffBucketUsesMoreRestrictiveLimit(t *testing.T) {
+	const bucketSize = 3600
+	now := time.Unix(1000*bucketSize, 0)
+
+	// Duration keeps the last 100 buckets; MaxBuckets keeps only the
+	// last 5. The tighter of the two (MaxBuckets) should win.
+	policy := RetentionPolicy{
+		Duration:   100 * time.Hour,
+		MaxBuckets: 5,
+	}
+	got := cutoffBucket(policy, now, bucketSize)
+	want := uint32(1000 - 5)
+	if got != want {
+		t.Errorf("cutoffBucket = %d, want %d (MaxBuckets should be more restrictive)", got, want)
+	}
+}
+
+func TestEffectiveMinTimePrefersPersistedValue(t *testing.T) {
+	const bucketSize = 3600
+	now := time.Unix(1000*bucketSize, 0)
+
+	policy := RetentionPolicy{Duration: time.Hour, MinTime: 42}
+	if got := policy.EffectiveMinTime(now, bucketSize); got != 42 {
+		t.Errorf("EffectiveMinTime = %d, want 42 (persisted MinTime should win)", got)
+	}
+}
+
+func TestEffectiveMinTimeFallsBackBeforeFirstReap(t *testing.T) {
+	const bucketSize = 3600
+	now := time.Unix(1000*bucketSize, 0)
+
+	policy := RetentionPolicy{Duration: time.Hour} // MinTime never computed yet
+	got := policy.EffectiveMinTime(now, bucketSize)
+	want := int64(cutoffBucket(policy, now, bucketSize)) * bucketSize
+	if got != want || got == 0 {
+		t.Errorf("EffectiveMinTime = %d, want %d (fallback to cutoffBucket)", got, want)
+	}
+}
+
+func TestEffectiveMinTimeNoLimitsIsZero(t *testing.T) {
+	const bucketSize = 3600
+	now := time.Unix(1000*bucketSize, 0)
+
+	if got := (RetentionPolicy{}).EffectiveMinTime(now, bucketSize); got != 0 {
+		t.Errorf("EffectiveMinTime with no limits = %d, want 0", got)
+	}
+}
@@ -1,16 +1,48 @@
 package tsdb
 
 import (
+	"context"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/golang/glog"
+	"github.com/hashicorp/raft"
+)
+
+const (
+	// WalFlushInterval is how often a shard's WAL is fsynced on a timer,
+	// independent of how many records have been buffered.
+	WalFlushInterval = 200 * time.Millisecond
+
+	// WalFlushEveryN fsyncs after this many buffered records even if
+	// WalFlushInterval hasn't elapsed yet.
+	WalFlushEveryN = 100
+
+	// CompactionInterval is how often each shard's Compactor looks for
+	// newly-eligible ranges of sealed buckets to merge.
+	CompactionInterval = 10 * time.Minute
+
+	// ReapInterval is how often each shard's Reaper enforces the
+	// configured RetentionPolicy.
+	ReapInterval = 5 * time.Minute
+
+	// MetricsAddr is where TsdbService.Start serves /metrics.
+	MetricsAddr = ":9090"
 )
 
 type TsdbService struct {
 	sync.RWMutex
-	buckets map[int]*BucketMap
-	ids     []int64
+	buckets    map[int]*BucketMap
+	wals       map[int]*WAL
+	storages   map[int]*BucketStorage
+	compactors map[int]*Compactor
+	reapers    map[int]*Reaper
+	retention  map[int]RetentionPolicy
+	tombstones map[int]*TombstoneLog
+	replicas   map[int]*ShardReplica
+	metrics    map[int]*metricsHooks
+	ids        []int64
 }
 
 func NewService() *TsdbService {
@@ -23,6 +55,14 @@ func (t *TsdbService) Start() (err error) {
 	t.ids[0] = 1
 
 	t.buckets = make(map[int]*BucketMap)
+	t.wals = make(map[int]*WAL)
+	t.storages = make(map[int]*BucketStorage)
+	t.compactors = make(map[int]*Compactor)
+	t.reapers = make(map[int]*Reaper)
+	t.retention = make(map[int]RetentionPolicy)
+	t.tombstones = make(map[int]*TombstoneLog)
+	t.replicas = make(map[int]*ShardReplica)
+	t.metrics = make(map[int]*metricsHooks)
 
 	k := NewKeyListWriter(DataDirectory_Test, 100)
 	b := NewBucketLogWriter(4*3600, DataDirectory_Test, 100, 0)
@@ -32,12 +72,53 @@ func (t *TsdbService) Start() (err error) {
 		if err := PathCreate(shardId); err != nil {
 			return err
 		}
-		t.buckets[int(shardId)] = NewBucketMap(6, 4*3600, shardId, DataDirectory_Test,
-			k, b, UNOWNED)
+		m := NewBucketMap(6, 4*3600, shardId, DataDirectory_Test, k, b, UNOWNED)
+		t.buckets[int(shardId)] = m
+		t.storages[int(shardId)] = m.Storage()
+
+		wal, err := NewWAL(DataDirectory_Test, shardId, WalFlushInterval, WalFlushEveryN)
+		if err != nil {
+			return err
+		}
+		t.wals[int(shardId)] = wal
+		m.SetWAL(wal)
+		t.compactors[int(shardId)] = NewCompactor(CompactionInterval)
+		t.reapers[int(shardId)] = NewReaper(ReapInterval)
+		t.metrics[int(shardId)] = m.Metrics()
+
+		policy, err := ReadRetentionPolicy(DataDirectory_Test, shardId)
+		if err != nil {
+			return err
+		}
+		t.retention[int(shardId)] = policy
+
+		tombstones, err := NewTombstoneLog(DataDirectory_Test, shardId)
+		if err != nil {
+			return err
+		}
+		t.tombstones[int(shardId)] = tombstones
+
+		if cfg, ok := ClusterConfigs[shardId]; ok {
+			replica, err := newLocalShardReplica(cfg, m, t.storages[int(shardId)], wal)
+			if err != nil {
+				return err
+			}
+			t.replicas[int(shardId)] = replica
+		}
 	}
 
+	go func() {
+		if err := ServeMetrics(MetricsAddr); err != nil {
+			glog.Errorf("metrics: serve %s: %v", MetricsAddr, err)
+		}
+	}()
+
 	// check
 	go func() {
+		ctx, span := startSpan(context.Background(), "TsdbService.Start.scan")
+		defer span.End()
+		_ = ctx
+
 		for _, m := range t.buckets {
 			if err := m.SetState(PRE_OWNED); err != nil {
 				glog.Fatal("set state failed")
@@ -63,73 +144,268 @@ func (t *TsdbService) Start() (err error) {
 			}
 		}
 
+		// Replay pending WAL records for each shard now that the sealed
+		// buckets have been loaded, so points that were written but
+		// never made it into a stored block aren't lost.
+		for _, shardId := range t.ids {
+			m := t.buckets[int(shardId)]
+			if err := ReplayWAL(DataDirectory_Test, shardId, func(rec *WalRecord) error {
+				_, _, err := m.PutByTimeSeriesId(rec.TimeSeriesId, TimeValuePair{
+					Value: rec.Value, Timestamp: rec.Timestamp}, rec.Category)
+				return err
+			}); err != nil {
+				glog.Fatal(err)
+			}
+		}
+
+		// Buckets are fully loaded now, so it's safe to start merging
+		// sealed ranges and reaping expired ones in the background.
+		for _, shardId := range t.ids {
+			id := int(shardId)
+			t.compactors[id].Start(shardId, t.buckets[id], t.storages[id], t.tombstones[id])
+			t.reapers[id].Start(shardId, t.buckets[id], t.storages[id],
+				func() RetentionPolicy {
+					t.RLock()
+					defer t.RUnlock()
+					return t.retention[id]
+				},
+				func(updated RetentionPolicy) {
+					t.Lock()
+					t.retention[id] = updated
+					t.Unlock()
+					if err := WriteRetentionPolicy(DataDirectory_Test, shardId, updated); err != nil {
+						glog.Errorf("reaper: shard %d: persist updated retention policy: %v", shardId, err)
+					}
+				})
+		}
 	}()
 
 	return nil
 }
 
-func (t *TsdbService) Put(req *PutRequest) (*PutResponse, error) {
+// Compact triggers an out-of-band compaction pass for shardId, in
+// addition to the periodic background pass each shard already runs.
+// Mainly useful for admin tooling and tests that don't want to wait
+// out a full CompactionInterval.
+func (t *TsdbService) Compact(shardId int64) error {
+	t.RLock()
+	c := t.compactors[int(shardId)]
+	m := t.buckets[int(shardId)]
+	storage := t.storages[int(shardId)]
+	tombstones := t.tombstones[int(shardId)]
+	t.RUnlock()
+
+	if c == nil || m == nil {
+		return fmt.Errorf("shard %d not owned", shardId)
+	}
+	return c.compactOnce(shardId, m, storage, tombstones)
+}
+
+// SetRetention installs and durably persists policy for shardId. It
+// takes effect on the reaper's next sweep and on the next Put.
+func (t *TsdbService) SetRetention(shardId int64, policy RetentionPolicy) error {
+	if err := WriteRetentionPolicy(DataDirectory_Test, shardId, policy); err != nil {
+		return err
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	if _, ok := t.buckets[int(shardId)]; !ok {
+		return fmt.Errorf("shard %d not owned", shardId)
+	}
+	t.retention[int(shardId)] = policy
+	return nil
+}
+
+// AddShardPeer adds a voting member to shardId's Raft group. The
+// shard must already be replicated (see NewShardReplica) before peers
+// can be added or removed.
+func (t *TsdbService) AddShardPeer(shardId int64, id raft.ServerID, addr raft.ServerAddress) error {
+	t.RLock()
+	replica := t.replicas[int(shardId)]
+	t.RUnlock()
+	if replica == nil {
+		return fmt.Errorf("shard %d is not raft-replicated", shardId)
+	}
+	return replica.AddPeer(id, addr)
+}
+
+// RemoveShardPeer removes a member from shardId's Raft group.
+func (t *TsdbService) RemoveShardPeer(shardId int64, id raft.ServerID) error {
+	t.RLock()
+	replica := t.replicas[int(shardId)]
+	t.RUnlock()
+	if replica == nil {
+		return fmt.Errorf("shard %d is not raft-replicated", shardId)
+	}
+	return replica.RemovePeer(id)
+}
+
+// Delete tombstones every sample of req.Key in [req.Begin, req.End]
+// for its shard. The underlying blocks are left untouched; Get
+// filters tombstoned samples out at read time, and a later
+// compaction pass rewrites the affected blocks and truncates the log.
+func (t *TsdbService) Delete(ctx context.Context, req *DeleteRequest) error {
+	_, span := startSpan(ctx, "TsdbService.Delete")
+	defer span.End()
+
+	shardId, timeSeriesId, err := t.resolveKey(req.Key)
+	if err != nil {
+		return err
+	}
+
+	t.RLock()
+	tombstones := t.tombstones[shardId]
+	t.RUnlock()
+	if tombstones == nil {
+		return fmt.Errorf("key not exit")
+	}
+
+	return tombstones.Add(Tombstone{
+		TimeSeriesId: timeSeriesId,
+		MinT:         req.Begin,
+		MaxT:         req.End,
+	})
+}
+
+// resolveKey maps a string key to the shard and time series id that
+// own it, mirroring the lookup Put/Get already do through BucketMap.
+func (t *TsdbService) resolveKey(key string) (shardId int, timeSeriesId uint32, err error) {
+	for id, m := range t.buckets {
+		if tsid, ok := m.LookupTimeSeriesId(key); ok {
+			return id, tsid, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("key not exit")
+}
+
+func (t *TsdbService) Put(ctx context.Context, req *PutRequest) (*PutResponse, error) {
+	ctx, span := startSpan(ctx, "TsdbService.Put")
+	defer span.End()
+
 	res := &PutResponse{}
 	for _, data := range req.Data {
-		m := t.buckets[int(data.Key.ShardId)]
-		if m == nil {
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+
+		shardId := int(data.Key.ShardId)
+		m := t.buckets[shardId]
+		wal := t.wals[shardId]
+		if m == nil || wal == nil {
 			return res, fmt.Errorf("key not exit")
 		}
 
-		newRows, dataPoints, err := m.Put(data.Key.Key, TimeValuePair{Value: data.Value.Value,
-			Timestamp: data.Value.Timestamp}, 0, false)
-		if err != nil {
+		metrics := t.metrics[shardId]
+
+		t.RLock()
+		policy := t.retention[shardId]
+		t.RUnlock()
+		if minTime := policy.EffectiveMinTime(time.Now(), TSDBConf.BucketSize); minTime > 0 && data.Value.Timestamp < minTime {
+			if metrics != nil {
+				metrics.observeDropped("expired")
+			}
+			return res, ErrBeforeRetention
+		}
+
+		// Durably record the point before it's applied in memory, so a
+		// crash between the two can't lose it.
+		if err := wal.Append(&WalRecord{
+			TimeSeriesId: GetTimeSeriesId(data.Key.Key),
+			Timestamp:    data.Value.Timestamp,
+			Value:        data.Value.Value,
+			Category:     0,
+		}); err != nil {
 			return res, err
 		}
 
-		if newRows == NOT_OWNED && dataPoints == NOT_OWNED {
-			return res, fmt.Errorf("key not own!")
+		t.RLock()
+		replica := t.replicas[shardId]
+		t.RUnlock()
+
+		if replica != nil {
+			// Raft-replicated shard: Put only returns once the write is
+			// applied locally as part of the committed log entry.
+			if err := replica.Put(data.Key.Key, TimeValuePair{Value: data.Value.Value,
+				Timestamp: data.Value.Timestamp}, 0); err != nil {
+				return res, err
+			}
+		} else {
+			newRows, dataPoints, err := m.Put(ctx, data.Key.Key, TimeValuePair{Value: data.Value.Value,
+				Timestamp: data.Value.Timestamp}, 0, false)
+			if err != nil {
+				return res, err
+			}
+
+			if newRows == NOT_OWNED && dataPoints == NOT_OWNED {
+				return res, fmt.Errorf("key not own!")
+			}
 		}
 
+		if metrics != nil {
+			metrics.observePut()
+		}
 		res.N++
 	}
 
 	return res, nil
 }
 
-func (t *TsdbService) Get(req *GetRequest) (*GetResponse, error) {
-	return nil, nil
-	/*
-		res := &GetResponse{}
-		if lne(req.Key.Key) == 0 {
-			return nil, fmt.Errorf("null key!")
-		}
+func (t *TsdbService) Get(ctx context.Context, req *GetRequest) (*GetResponse, error) {
+	ctx, span := startSpan(ctx, "TsdbService.Get")
+	defer span.End()
 
-		m := t.buckets[int(req.ShardId)]
-		if m == nil {
-			return nil, fmt.Errorf("key not exit")
-		}
+	if len(req.Key.Key) == 0 {
+		return nil, fmt.Errorf("null key!")
+	}
 
-		res.Key = req.Key
-		state := m.GetState()
-		switch state {
-		case UNOWNED:
-			return nil, fmt.Errorf("Don't own shard %d", req.ShardId)
-		case PRE_OWNED, READING_KEYS, READING_KEYS_DONE, READING_LOGS, PROCESSING_QUEUED_DATA_POINTS:
-			return nil, fmt.Errorf("Shard %d in progress", req.ShardId)
-		default:
-			datas, err := m.Get(req.Key, req.Begin, req.End)
-			if err != nil {
-				return res, err
-			}
+	shardId := int(req.Key.ShardId)
 
-			for _, dp := range datas {
-				res.Dps = append(res.Dps, &DataPoint{Value: dp.Value, Timestamp: dp.Timestamp})
-			}
+	t.RLock()
+	m := t.buckets[shardId]
+	replica := t.replicas[shardId]
+	tombstones := t.tombstones[shardId]
+	t.RUnlock()
+	if m == nil {
+		return nil, fmt.Errorf("key not exit")
+	}
 
-			if state == READING_BLOCK_DATA {
-				return res, fmt.Errorf("Shard %d in progress", req.ShardId)
-			} else if req.Begin < m.GetReliableDataStartTime() {
-				return res, fmt.Errorf("missing too much data")
-			}
+	res := &GetResponse{Key: req.Key}
 
-			return res, nil
+	state := m.GetState()
+	switch state {
+	case UNOWNED:
+		return nil, fmt.Errorf("Don't own shard %d", req.Key.ShardId)
+	case PRE_OWNED, READING_KEYS, READING_KEYS_DONE, READING_LOGS, PROCESSING_QUEUED_DATA_POINTS:
+		return nil, fmt.Errorf("Shard %d in progress", req.Key.ShardId)
+	}
 
+	var blocks []*TimeSeriesBlock
+	var err error
+	if replica != nil {
+		// Raft-replicated shard: let a follower answer from its own
+		// state instead of always forwarding reads to the leader.
+		blocks, err = replica.Get(req.Begin, req.End, req.Key.Key, true)
+	} else {
+		blocks, err = m.Get(ctx, req.Key.Key, req.Begin, req.End, tombstones)
+	}
+	if err != nil {
+		return res, err
+	}
+
+	for _, block := range blocks {
+		for _, dp := range block.Data {
+			res.Dps = append(res.Dps, &DataPoint{Value: dp.Value, Timestamp: dp.Timestamp})
 		}
-	*/
+	}
+
+	if state == READING_BLOCK_DATA {
+		return res, fmt.Errorf("Shard %d in progress", req.Key.ShardId)
+	}
+	// The earlier draft of this method also checked req.Begin against
+	// a BucketMap.GetReliableDataStartTime, but that method was never
+	// defined anywhere in this tree; rather than invent one to match a
+	// stale comment, the check is left out until a real notion of
+	// "reliable data start" exists to back it.
+	return res, nil
 }
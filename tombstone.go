@@ -0,0 +1,193 @@
+// Tombstone-based deletion: Delete marks a time range as gone without
+// rewriting any block in place, the same trade-off Prometheus' TSDB
+// makes. Get filters tombstoned samples out at read time; compaction
+// later rewrites affected blocks and truncates the log (see compact.go).
+package tsdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const tombstoneFileName = "tombstones"
+
+// Tombstone marks [MinT, MaxT] (inclusive) of one series as deleted.
+type Tombstone struct {
+	TimeSeriesId uint32
+	MinT         int64
+	MaxT         int64
+}
+
+// TombstoneLog is an append-only record of Tombstones for one shard,
+// consulted by every Get and replayed on startup.
+type TombstoneLog struct {
+	sync.RWMutex
+
+	path   string
+	file   *os.File
+	writer *bufio.Writer
+	byId   map[uint32][]Tombstone
+}
+
+// NewTombstoneLog opens (creating if necessary) the tombstone log for
+// shardId and replays any existing entries into memory.
+func NewTombstoneLog(dataDirectory string, shardId int64) (*TombstoneLog, error) {
+	path := filepath.Join(dataDirectory, fmt.Sprintf("%d", shardId), tombstoneFileName)
+
+	t := &TombstoneLog{
+		path: path,
+		byId: make(map[uint32][]Tombstone),
+	}
+	if err := t.replay(); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	t.file = f
+	t.writer = bufio.NewWriter(f)
+	return t, nil
+}
+
+func (t *TombstoneLog) replay() error {
+	f, err := os.Open(t.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	buf := make([]byte, 20)
+	for {
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil
+		}
+		ts := decodeTombstone(buf)
+		t.byId[ts.TimeSeriesId] = append(t.byId[ts.TimeSeriesId], ts)
+	}
+}
+
+// Add appends ts to the log and makes it immediately visible to Get.
+func (t *TombstoneLog) Add(ts Tombstone) error {
+	t.Lock()
+	defer t.Unlock()
+
+	buf := encodeTombstone(ts)
+	if _, err := t.writer.Write(buf); err != nil {
+		return err
+	}
+	if err := t.writer.Flush(); err != nil {
+		return err
+	}
+	if err := t.file.Sync(); err != nil {
+		return err
+	}
+
+	t.byId[ts.TimeSeriesId] = append(t.byId[ts.TimeSeriesId], ts)
+	return nil
+}
+
+// Covers reports whether timestamp ts falls inside any active
+// tombstone for timeSeriesId.
+func (t *TombstoneLog) Covers(timeSeriesId uint32, ts int64) bool {
+	t.RLock()
+	defer t.RUnlock()
+
+	for _, tomb := range t.byId[timeSeriesId] {
+		if ts >= tomb.MinT && ts <= tomb.MaxT {
+			return true
+		}
+	}
+	return false
+}
+
+// TruncateBefore drops every tombstone whose MaxT falls before
+// cutoffBucket (in units of bucketSize), keeping the rest, then
+// rewrites both the in-memory index and the on-disk log. A tombstone
+// is only safe to drop once compaction has rewritten every block it
+// could have covered - dropping it any earlier would let Get's live
+// filtering stop catching a sample that's still sitting, unmerged, in
+// a raw per-bucket block.
+func (t *TombstoneLog) TruncateBefore(cutoffBucket uint32, bucketSize uint32) error {
+	t.Lock()
+	defer t.Unlock()
+
+	kept := make(map[uint32][]Tombstone)
+	for id, tombs := range t.byId {
+		for _, ts := range tombs {
+			if uint32(ts.MaxT)/bucketSize < cutoffBucket {
+				continue
+			}
+			kept[id] = append(kept[id], ts)
+		}
+	}
+
+	if err := t.file.Close(); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(t.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	t.file = f
+	t.writer = bufio.NewWriter(f)
+	for _, tombs := range kept {
+		for _, ts := range tombs {
+			if _, err := t.writer.Write(encodeTombstone(ts)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := t.writer.Flush(); err != nil {
+		return err
+	}
+	if err := t.file.Sync(); err != nil {
+		return err
+	}
+	t.byId = kept
+	return nil
+}
+
+// Close flushes and releases the log file.
+func (t *TombstoneLog) Close() error {
+	t.Lock()
+	defer t.Unlock()
+	if err := t.writer.Flush(); err != nil {
+		return err
+	}
+	return t.file.Close()
+}
+
+func encodeTombstone(ts Tombstone) []byte {
+	buf := make([]byte, 20)
+	binary.BigEndian.PutUint32(buf[0:4], ts.TimeSeriesId)
+	binary.BigEndian.PutUint64(buf[4:12], uint64(ts.MinT))
+	binary.BigEndian.PutUint64(buf[12:20], uint64(ts.MaxT))
+	return buf
+}
+
+func decodeTombstone(buf []byte) Tombstone {
+	return Tombstone{
+		TimeSeriesId: binary.BigEndian.Uint32(buf[0:4]),
+		MinT:         int64(binary.BigEndian.Uint64(buf[4:12])),
+		MaxT:         int64(binary.BigEndian.Uint64(buf[12:20])),
+	}
+}
+
+// DeleteRequest asks for every sample of Key in [Begin, End] to be
+// tombstoned.
+type DeleteRequest struct {
+	Key   string
+	Begin int64
+	End   int64
+}
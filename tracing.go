@@ -0,0 +1,22 @@
+// Tracing helpers shared by the shard-level storage operations so
+// per-query latency can be attributed to fetch vs. decode vs.
+// lock-wait time.
+package tsdb
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer is the package-wide OpenTelemetry tracer. Using a single
+// named tracer keeps span names consistent across Put/Get/Store/Fetch.
+var tracer = otel.Tracer("github.com/huangaz/tsdb")
+
+// startSpan opens a span named name as a child of ctx and returns the
+// derived context plus the span to End when the operation completes.
+// Callers are expected to `defer span.End()` immediately.
+func startSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name)
+}
@@ -0,0 +1,353 @@
+// Write-ahead log for the active (unsealed) bucket of every shard.
+//
+// Each shard gets its own segmented, checksummed log under
+// <dataDirectory>/<shardId>/wal/. Records are appended before the
+// corresponding in-memory Put returns, so a crash only loses whatever
+// hasn't been fsynced yet, not the whole active bucket.
+package tsdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	walDirName        = "wal"
+	walSegmentPrefix  = "wal-"
+	walDefaultMaxSize = 128 * 1024 * 1024 // rotate a segment past this size
+)
+
+// WalRecord is a single pending write: one data point for one series.
+type WalRecord struct {
+	TimeSeriesId uint32
+	Timestamp    int64
+	Value        float64
+	Category     uint16
+}
+
+// WAL is a segmented, checksummed append-only log of WalRecords for a
+// single shard's active buckets.
+type WAL struct {
+	sync.Mutex
+
+	dir         string
+	maxSegBytes int64
+	flushEvery  time.Duration
+	flushEveryN int
+
+	segmentId int
+	file      *os.File
+	writer    *bufio.Writer
+	fileBytes int64
+	unflushed int
+	lastFlush time.Time
+	closed    bool
+}
+
+// NewWAL opens (creating if necessary) the WAL directory for shardId
+// under dataDirectory, and starts a fresh segment for writing.
+// flushEvery and flushEveryN control how often Append forces an fsync;
+// a zero value disables that trigger (the other one still applies).
+func NewWAL(dataDirectory string, shardId int64, flushEvery time.Duration,
+	flushEveryN int) (*WAL, error) {
+
+	dir := filepath.Join(dataDirectory, fmt.Sprintf("%d", shardId), walDirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	w := &WAL{
+		dir:         dir,
+		maxSegBytes: walDefaultMaxSize,
+		flushEvery:  flushEvery,
+		flushEveryN: flushEveryN,
+		lastFlush:   time.Now(),
+	}
+
+	segmentId, err := nextWalSegmentId(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := w.openSegment(segmentId); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func nextWalSegmentId(dir string) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	max := -1
+	for _, e := range entries {
+		var id int
+		if _, err := fmt.Sscanf(e.Name(), walSegmentPrefix+"%d", &id); err == nil {
+			if id > max {
+				max = id
+			}
+		}
+	}
+	return max + 1, nil
+}
+
+func (w *WAL) segmentPath(id int) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%s%08d", walSegmentPrefix, id))
+}
+
+func (w *WAL) openSegment(id int) error {
+	f, err := os.OpenFile(w.segmentPath(id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.segmentId = id
+	w.file = f
+	w.writer = bufio.NewWriter(f)
+	w.fileBytes = fi.Size()
+	return nil
+}
+
+// Append writes rec to the active segment, rotating or flushing as
+// configured. It returns once the record is buffered; durability is
+// governed by the flush interval/count, not by Append itself.
+func (w *WAL) Append(rec *WalRecord) error {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.closed {
+		return fmt.Errorf("wal: append to closed log")
+	}
+
+	buf := encodeWalRecord(rec)
+	n, err := w.writer.Write(buf)
+	if err != nil {
+		return err
+	}
+	w.fileBytes += int64(n)
+	w.unflushed++
+
+	shouldFlush := (w.flushEveryN > 0 && w.unflushed >= w.flushEveryN) ||
+		(w.flushEvery > 0 && time.Since(w.lastFlush) >= w.flushEvery)
+	if shouldFlush {
+		if err := w.flushLocked(); err != nil {
+			return err
+		}
+	}
+
+	if w.fileBytes >= w.maxSegBytes {
+		return w.rotateLocked()
+	}
+	return nil
+}
+
+func (w *WAL) flushLocked() error {
+	if err := w.writer.Flush(); err != nil {
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	w.unflushed = 0
+	w.lastFlush = time.Now()
+	return nil
+}
+
+func (w *WAL) rotateLocked() error {
+	if err := w.flushLocked(); err != nil {
+		return err
+	}
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	return w.openSegment(w.segmentId + 1)
+}
+
+// Flush forces any buffered records out to stable storage.
+func (w *WAL) Flush() error {
+	w.Lock()
+	defer w.Unlock()
+	return w.flushLocked()
+}
+
+// Close flushes and releases the active segment.
+func (w *WAL) Close() error {
+	w.Lock()
+	defer w.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if err := w.flushLocked(); err != nil {
+		return err
+	}
+	return w.file.Close()
+}
+
+// CurrentSegmentId returns the id of the segment currently open for
+// writes, so a caller coordinating truncation across multiple writers
+// (see BucketMap.notePersisted) can record a low-watermark against it.
+func (w *WAL) CurrentSegmentId() int {
+	w.Lock()
+	defer w.Unlock()
+	return w.segmentId
+}
+
+// Offset returns the id of the segment currently open for writes, as a
+// record of where the WAL stood when a snapshot was taken. It's not a
+// safe bound to resume replay from: TruncateBefore already deletes any
+// segment once every series has rolled past it, so whatever's left on
+// disk at restore time may still hold not-yet-sealed data and has to
+// be replayed in full (see shardFSM.Restore).
+func (w *WAL) Offset() int64 {
+	return int64(w.CurrentSegmentId())
+}
+
+// TruncateBefore deletes every sealed segment strictly older than
+// segmentId; the active segment and anything at or after segmentId is
+// left alone. Unlike a blanket "delete everything but the active
+// segment", this lets a caller that's tracking per-writer progress
+// (BucketMap, which owns every series sharing this WAL) only discard
+// records once it knows every writer has moved past them - a single
+// series persisting a bucket is not by itself enough to know that.
+func (w *WAL) TruncateBefore(segmentId int) error {
+	w.Lock()
+	defer w.Unlock()
+
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		var id int
+		if _, err := fmt.Sscanf(e.Name(), walSegmentPrefix+"%d", &id); err != nil {
+			continue
+		}
+		if id >= segmentId {
+			continue
+		}
+		if err := os.Remove(filepath.Join(w.dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// record wire format: [4 bytes length][length bytes payload][4 bytes crc32].
+func encodeWalRecord(rec *WalRecord) []byte {
+	payload := make([]byte, 4+8+8+2)
+	binary.BigEndian.PutUint32(payload[0:4], rec.TimeSeriesId)
+	binary.BigEndian.PutUint64(payload[4:12], uint64(rec.Timestamp))
+	binary.BigEndian.PutUint64(payload[12:20], math.Float64bits(rec.Value))
+	binary.BigEndian.PutUint16(payload[20:22], rec.Category)
+
+	out := make([]byte, 4+len(payload)+4)
+	binary.BigEndian.PutUint32(out[0:4], uint32(len(payload)))
+	copy(out[4:], payload)
+	crc := crc32.ChecksumIEEE(payload)
+	binary.BigEndian.PutUint32(out[4+len(payload):], crc)
+	return out
+}
+
+func decodeWalRecord(payload []byte) *WalRecord {
+	return &WalRecord{
+		TimeSeriesId: binary.BigEndian.Uint32(payload[0:4]),
+		Timestamp:    int64(binary.BigEndian.Uint64(payload[4:12])),
+		Value:        math.Float64frombits(binary.BigEndian.Uint64(payload[12:20])),
+		Category:     binary.BigEndian.Uint16(payload[20:22]),
+	}
+}
+
+// ReplayWAL reads every segment for shardId in order and invokes apply
+// for each recovered record, so pending points that never made it into
+// a sealed bucket can be re-applied to the in-memory buckets on
+// startup. Replay stops at the first corrupt record, logging the
+// segment and byte offset it stopped at, rather than risking silently
+// skipping good data that follows a torn write.
+func ReplayWAL(dataDirectory string, shardId int64, apply func(*WalRecord) error) error {
+	dir := filepath.Join(dataDirectory, fmt.Sprintf("%d", shardId), walDirName)
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	segmentIds := make([]int, 0, len(entries))
+	for _, e := range entries {
+		var id int
+		if _, err := fmt.Sscanf(e.Name(), walSegmentPrefix+"%d", &id); err == nil {
+			segmentIds = append(segmentIds, id)
+		}
+	}
+	sort.Ints(segmentIds)
+
+	for _, id := range segmentIds {
+		path := filepath.Join(dir, fmt.Sprintf("%s%08d", walSegmentPrefix, id))
+		if err := replaySegment(path, apply); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func replaySegment(path string, apply func(*WalRecord) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	offset := int64(0)
+	for {
+		lenBuf := make([]byte, 4)
+		if _, err := io.ReadFull(r, lenBuf); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			glog.Errorf("wal: corrupt length header in %s at offset %d: %v", path, offset, err)
+			return nil
+		}
+		length := binary.BigEndian.Uint32(lenBuf)
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			glog.Errorf("wal: truncated record in %s at offset %d: %v", path, offset, err)
+			return nil
+		}
+
+		crcBuf := make([]byte, 4)
+		if _, err := io.ReadFull(r, crcBuf); err != nil {
+			glog.Errorf("wal: truncated crc in %s at offset %d: %v", path, offset, err)
+			return nil
+		}
+		wantCrc := binary.BigEndian.Uint32(crcBuf)
+		gotCrc := crc32.ChecksumIEEE(payload)
+		if wantCrc != gotCrc {
+			glog.Errorf("wal: crc mismatch in %s at offset %d, stopping replay", path, offset)
+			return nil
+		}
+
+		if err := apply(decodeWalRecord(payload)); err != nil {
+			return err
+		}
+		offset += int64(4 + len(payload) + 4)
+	}
+}
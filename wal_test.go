@@ -0,0 +1,91 @@
+package tsdb
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestWALAppendAndReplay(t *testing.T) {
+	dir, err := os.MkdirTemp("", "wal_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := NewWAL(dir, 1, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []*WalRecord{
+		{TimeSeriesId: 1, Timestamp: 100, Value: 1.5, Category: 2},
+		{TimeSeriesId: 1, Timestamp: 200, Value: 2.5, Category: 2},
+		{TimeSeriesId: 2, Timestamp: 150, Value: -3.5, Category: 0},
+	}
+	for _, rec := range want {
+		if err := w.Append(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []*WalRecord
+	if err := ReplayWAL(dir, 1, func(rec *WalRecord) error {
+		got = append(got, rec)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("replayed %d records, want %d", len(got), len(want))
+	}
+	for i, rec := range got {
+		if *rec != *want[i] {
+			t.Errorf("record %d = %+v, want %+v", i, rec, want[i])
+		}
+	}
+}
+
+func TestWALTruncateBeforeKeepsNewerSegments(t *testing.T) {
+	dir, err := os.MkdirTemp("", "wal_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := NewWAL(dir, 1, time.Hour, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.maxSegBytes = 1 // force a rotation on every Append
+
+	for i := 0; i < 3; i++ {
+		if err := w.Append(&WalRecord{TimeSeriesId: 1, Timestamp: int64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	last := w.CurrentSegmentId()
+	if last < 2 {
+		t.Fatalf("expected at least 3 segments, landed on segment %d", last)
+	}
+
+	// Only the oldest segment is safe to drop; segment `last` (active)
+	// and anything from `last-1` onward must survive.
+	if err := w.TruncateBefore(last - 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(w.segmentPath(0)); !os.IsNotExist(err) {
+		t.Errorf("segment 0 should have been removed, stat err = %v", err)
+	}
+	if _, err := os.Stat(w.segmentPath(last - 1)); err != nil {
+		t.Errorf("segment %d should still exist: %v", last-1, err)
+	}
+	if _, err := os.Stat(w.segmentPath(last)); err != nil {
+		t.Errorf("active segment %d should still exist: %v", last, err)
+	}
+}